@@ -0,0 +1,16 @@
+package api
+
+import "errors"
+
+// Sentinel errors a panel client's GetNodeInfo/GetUserList/GetNodeRule can
+// return once it has an ETag (or hash) handshake in place, to tell the
+// caller the underlying resource is unchanged since the last successful
+// fetch. Callers should check for these with errors.Is and skip
+// re-applying config rather than treating them as failures. Any client
+// implementing API (see api.go) is expected to reuse these rather than
+// defining its own.
+var (
+	ErrNodeNotModified  = errors.New("api: node config not modified")
+	ErrUsersNotModified = errors.New("api: user list not modified")
+	ErrRuleNotModified  = errors.New("api: rule list not modified")
+)
@@ -2,12 +2,21 @@ package pmpanel
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -17,6 +26,37 @@ import (
 	"github.com/nohara-cloud/nboard-node/api"
 )
 
+const (
+	// defaultTrafficChunkSize is used when api.Config.TrafficChunkSize is unset.
+	defaultTrafficChunkSize = 500
+	// gzipThreshold is the payload size above which requests are gzip-encoded.
+	gzipThreshold = 1024
+	// spoolBaseBackoff and spoolMaxBackoff bound the exponential backoff
+	// applied to spool replay after a failed attempt.
+	spoolBaseBackoff = 5 * time.Second
+	spoolMaxBackoff  = 5 * time.Minute
+	// defaultRuleUpdatePeriod is used when api.Config.RuleUpdatePeriod is unset.
+	defaultRuleUpdatePeriod = 60 * time.Second
+	// spoolMaxEntries bounds SpoolDir so an extended panel outage can't fill
+	// the disk. Once full, spool drops the oldest entry to make room for the
+	// newest one, i.e. it behaves like a true ring buffer.
+	spoolMaxEntries = 1000
+)
+
+// logrusLogger adapts a *logrus.Entry to the api.Logger interface; it's the
+// default sink used when api.Config.Logger isn't set.
+type logrusLogger struct {
+	entry *log.Entry
+}
+
+func (l *logrusLogger) WithField(key string, value interface{}) api.Logger {
+	return &logrusLogger{entry: l.entry.WithField(key, value)}
+}
+func (l *logrusLogger) Debugf(format string, args ...interface{}) { l.entry.Debugf(format, args...) }
+func (l *logrusLogger) Infof(format string, args ...interface{})  { l.entry.Infof(format, args...) }
+func (l *logrusLogger) Warnf(format string, args ...interface{})  { l.entry.Warnf(format, args...) }
+func (l *logrusLogger) Errorf(format string, args ...interface{}) { l.entry.Errorf(format, args...) }
+
 // APIClient create a api client to the panel.
 type APIClient struct {
 	client        *resty.Client
@@ -26,13 +66,69 @@ type APIClient struct {
 	NodeType      string
 	EnableVless   bool
 	VlessFlow     string
+	EnableXTLS    bool
 	SpeedLimit    float64
 	DeviceLimit   int
 	LocalRuleList []api.DetectRule
+
+	TrafficChunkSize int
+	SpoolDir         string
+	RuleUpdatePeriod time.Duration
+
+	nodeInfoETag string
+	userListETag string
+	ruleETag     string
+
+	lastNodeInfo *api.NodeInfo
+	lastUserList *[]api.UserInfo
+	lastRuleList *[]api.DetectRule
+
+	reportedTotal uint64
+	spooledTotal  uint64
+	replayedTotal uint64
+
+	spoolMu       sync.Mutex
+	spoolSeq      uint64
+	replayBackoff time.Duration
+	nextReplayAt  time.Time
+
+	logger api.Logger
+}
+
+// Metrics is a snapshot of the traffic-reporting counters.
+type Metrics struct {
+	ReportedTotal uint64
+	SpooledTotal  uint64
+	ReplayedTotal uint64
+}
+
+// Metrics returns a snapshot of the reported/spooled/replayed counters.
+func (c *APIClient) Metrics() Metrics {
+	return Metrics{
+		ReportedTotal: atomic.LoadUint64(&c.reportedTotal),
+		SpooledTotal:  atomic.LoadUint64(&c.spooledTotal),
+		ReplayedTotal: atomic.LoadUint64(&c.replayedTotal),
+	}
+}
+
+// hashResponse returns a sha256 hex digest of body, used as a stand-in
+// change token for panels that don't emit an ETag header.
+func hashResponse(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
 }
 
 // New creat a api instance
-func New(apiConfig *api.Config) *APIClient {
+func New(apiConfig *api.Config) (*APIClient, error) {
+
+	logger := apiConfig.Logger
+	if logger == nil {
+		logger = &logrusLogger{entry: log.WithFields(log.Fields{
+			"node_id":   apiConfig.NodeID,
+			"node_type": apiConfig.NodeType,
+			"api_host":  apiConfig.APIHost,
+		})}
+	}
 
 	client := resty.New()
 	client.SetRetryCount(3)
@@ -45,8 +141,27 @@ func New(apiConfig *api.Config) *APIClient {
 		if v, ok := err.(*resty.ResponseError); ok {
 			// v.Response contains the last response from the server
 			// v.Err contains the original error
-			log.Print(v.Err)
+			logger.Errorf("%s", v.Err)
+		}
+	})
+	// Gzip-encode outgoing request bodies once they're big enough that the
+	// CPU cost of compressing pays for itself on the wire.
+	client.OnBeforeRequest(func(cl *resty.Client, req *resty.Request) error {
+		payload, ok := req.Body.([]byte)
+		if !ok || len(payload) <= gzipThreshold {
+			return nil
+		}
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(payload); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
 		}
+		req.SetBody(buf.Bytes())
+		req.SetHeader("Content-Encoding", "gzip")
+		return nil
 	})
 	client.SetBaseURL(apiConfig.APIHost)
 	// Add authorization key for each requests
@@ -55,15 +170,22 @@ func New(apiConfig *api.Config) *APIClient {
 	})
 	nodeType := strings.ToLower(apiConfig.NodeType)
 	if nodeType != "shadowsocks" && nodeType != "v2ray" && nodeType != "trojan" {
-		return nil
+		return nil, fmt.Errorf("unsupported node type: %s", apiConfig.NodeType)
 	}
-	log.Printf("Getting node info, Type: %s, NodeID: %s", nodeType, apiConfig.NodeID)
+	logger.Infof("Getting node info, Type: %s, NodeID: %s", nodeType, apiConfig.NodeID)
 	client.SetQueryParams(map[string]string{
 		"protocol": nodeType,
 		"node_id":  apiConfig.NodeID,
 	})
 	// Read local rule list
-	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
+	localRuleList, err := readLocalRuleList(apiConfig.RuleListPath, logger)
+	if err != nil {
+		return nil, err
+	}
+	ruleUpdatePeriod := time.Duration(apiConfig.RuleUpdatePeriod) * time.Second
+	if ruleUpdatePeriod <= 0 {
+		ruleUpdatePeriod = defaultRuleUpdatePeriod
+	}
 	apiClient := &APIClient{
 		client:        client,
 		NodeID:        apiConfig.NodeID,
@@ -72,26 +194,35 @@ func New(apiConfig *api.Config) *APIClient {
 		NodeType:      apiConfig.NodeType,
 		EnableVless:   apiConfig.EnableVless,
 		VlessFlow:     apiConfig.VlessFlow,
+		EnableXTLS:    apiConfig.EnableXTLS,
 		SpeedLimit:    apiConfig.SpeedLimit,
 		DeviceLimit:   apiConfig.DeviceLimit,
 		LocalRuleList: localRuleList,
+
+		TrafficChunkSize: apiConfig.TrafficChunkSize,
+		SpoolDir:         apiConfig.TrafficSpoolDir,
+		RuleUpdatePeriod: ruleUpdatePeriod,
+
+		logger: logger,
 	}
-	return apiClient
+	return apiClient, nil
 }
 
-// readLocalRuleList reads the local rule list file
-func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
+// readLocalRuleList reads the local rule list file. A missing or unreadable
+// file is returned as an error to the caller rather than killing the
+// process, since it may just be a transient IO problem.
+func readLocalRuleList(path string, logger api.Logger) ([]api.DetectRule, error) {
 
-	LocalRuleList = make([]api.DetectRule, 0)
+	LocalRuleList := make([]api.DetectRule, 0)
 	if path != "" {
 		// open the file
 		file, err := os.Open(path)
 
 		// handle errors while opening
 		if err != nil {
-			log.Printf("Error when opening file: %s", err)
-			return LocalRuleList
+			return nil, fmt.Errorf("error when opening file: %s", err)
 		}
+		defer file.Close()
 
 		fileScanner := bufio.NewScanner(file)
 
@@ -104,14 +235,12 @@ func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
 		}
 		// handle first encountered error while reading
 		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
-			return
+			return nil, fmt.Errorf("error while reading file: %s", err)
 		}
-
-		file.Close()
+		logger.Debugf("Loaded %d local rule(s) from %s", len(LocalRuleList), path)
 	}
 
-	return LocalRuleList
+	return LocalRuleList, nil
 }
 
 // Describe return a description of the client
@@ -154,23 +283,36 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 	path := fmt.Sprintf("/api/node/config")
 
-	res, err := c.client.R().
-		ForceContentType("application/json").
-		Get(path)
+	req := c.client.R().ForceContentType("application/json")
+	if c.nodeInfoETag != "" {
+		req.SetHeader("If-None-Match", c.nodeInfoETag)
+	}
+	res, err := req.Get(path)
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode() == http.StatusNotModified {
+		return c.lastNodeInfo, api.ErrNodeNotModified
+	}
 
 	responseData, err := c.parseResponse(res, path, err)
 	if err != nil {
 		return nil, err
 	}
 
+	etag := res.Header().Get("ETag")
+	if etag == "" {
+		etag = hashResponse(responseData)
+	}
+	if etag == c.nodeInfoETag {
+		return c.lastNodeInfo, api.ErrNodeNotModified
+	}
+
 	nodeInfoResponse := new(NodeInfoResponse)
 	if err := json.Unmarshal(responseData, nodeInfoResponse); err != nil {
 		return nil, fmt.Errorf("unmarshal %s failed: %s", reflect.TypeOf(nodeInfoResponse), err)
 	}
-	log.Printf("nodeInfoResponse: %+v", nodeInfoResponse)
+	c.logger.Debugf("nodeInfoResponse: %+v", nodeInfoResponse)
 	switch c.NodeType {
 	case "V2ray":
 		nodeInfo, err = c.ParseV2rayNodeResponse(nodeInfoResponse)
@@ -187,21 +329,38 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		return nil, fmt.Errorf("Parse node info failed: %s, \nError: %s", string(res), err)
 	}
 
+	c.nodeInfoETag = etag
+	c.lastNodeInfo = nodeInfo
+
 	return nodeInfo, nil
 }
 
 // GetUserList will pull user from panel
 func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	path := "/api/node/user"
-	res, err := c.client.R().
-		ForceContentType("application/json").
-		Get(path)
-	log.Printf("[PMPanel] Get user list for node: %s", c.NodeID)
+	req := c.client.R().ForceContentType("application/json")
+	if c.userListETag != "" {
+		req.SetHeader("If-None-Match", c.userListETag)
+	}
+	res, err := req.Get(path)
+	c.logger.Debugf("Get user list for node: %s", c.NodeID)
+	if err == nil && res.StatusCode() == http.StatusNotModified {
+		return c.lastUserList, api.ErrUsersNotModified
+	}
+
 	responseData, err := c.parseResponse(res, path, err)
 	if err != nil {
 		return nil, err
 	}
 
+	etag := res.Header().Get("ETag")
+	if etag == "" {
+		etag = hashResponse(responseData)
+	}
+	if etag == c.userListETag {
+		return c.lastUserList, api.ErrUsersNotModified
+	}
+
 	var userListResponse *[]UserResponse
 	if err := json.Unmarshal(responseData, &userListResponse); err != nil {
 		return nil, fmt.Errorf("unmarshal %s failed: %s", reflect.TypeOf(userListResponse), err)
@@ -211,6 +370,10 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		res, _ := json.Marshal(userListResponse)
 		return nil, fmt.Errorf("parse user list failed: %s", string(res))
 	}
+
+	c.userListETag = etag
+	c.lastUserList = userList
+
 	return userList, nil
 }
 
@@ -224,44 +387,34 @@ func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
 		Uptime: nodeStatus.Uptime,
 	}
 
-	path := "/api/node/status"
-	res, err := c.client.R().
-		ForceContentType("application/json").
-		SetBody(data).
-		Post(path)
-
-	_, err = c.parseResponse(res, path, err)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return c.doPost("/api/node/status", data)
 }
 
-// ReportNodeOnlineUsers reports online user ip
+// ReportNodeOnlineUsers reports online user ip. Every chunk is posted (and
+// spooled on failure) regardless of earlier chunks failing, so one bad chunk
+// doesn't drop the rest of the batch; the error of the last chunk that
+// failed, if any, is returned to the caller.
 func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) error {
 	data := make([]OnlineUser, len(*onlineUserList))
 	for i, user := range *onlineUserList {
 		data[i] = OnlineUser{UID: user.UID, IP: user.IP}
 	}
 
-	postData := &OnlineUserPostData{Online: data}
 	path := "/api/node/user/online"
-	res, err := c.client.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(postData).
-		ForceContentType("application/json").
-		Post(path)
-
-	_, err = c.parseResponse(res, path, err)
-	if err != nil {
-		return err
+	var lastErr error
+	for _, chunk := range c.chunkOnlineUsers(data) {
+		if err := c.doPost(path, &OnlineUserPostData{Online: chunk}); err != nil {
+			lastErr = err
+		}
 	}
 
-	return nil
+	return lastErr
 }
 
-// ReportUserTraffic reports the user traffic
+// ReportUserTraffic reports the user traffic. Every chunk is posted (and
+// spooled on failure) regardless of earlier chunks failing, so one bad chunk
+// doesn't drop the rest of the batch's billing data; the error of the last
+// chunk that failed, if any, is returned to the caller.
 func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 	data := make([]UserTraffic, len(*userTraffic))
 	for i, traffic := range *userTraffic {
@@ -272,105 +425,360 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 		}
 	}
 
-	postData := &TrafficPostData{Traffic: data}
 	path := "/api/node/user/traffic"
+	var lastErr error
+	for _, chunk := range c.chunkUserTraffic(data) {
+		if err := c.doPost(path, &TrafficPostData{Traffic: chunk}); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// chunkUserTraffic splits traffic reports into groups of at most
+// TrafficChunkSize so a large node doesn't hit the panel's request-size
+// limit in a single POST.
+func (c *APIClient) chunkUserTraffic(data []UserTraffic) [][]UserTraffic {
+	size := c.TrafficChunkSize
+	if size <= 0 {
+		size = defaultTrafficChunkSize
+	}
+	chunks := make([][]UserTraffic, 0, len(data)/size+1)
+	for size < len(data) {
+		data, chunks = data[size:], append(chunks, data[:size:size])
+	}
+	return append(chunks, data)
+}
+
+// chunkOnlineUsers splits online-user reports the same way chunkUserTraffic does.
+func (c *APIClient) chunkOnlineUsers(data []OnlineUser) [][]OnlineUser {
+	size := c.TrafficChunkSize
+	if size <= 0 {
+		size = defaultTrafficChunkSize
+	}
+	chunks := make([][]OnlineUser, 0, len(data)/size+1)
+	for size < len(data) {
+		data, chunks = data[size:], append(chunks, data[:size:size])
+	}
+	return append(chunks, data)
+}
+
+// doPost marshals body to JSON and POSTs it to path (gzip-encoding happens
+// transparently via the client's OnBeforeRequest hook). When SpoolDir is
+// set, a failed POST is spooled to disk there instead of being dropped, and
+// replayed, oldest first, the next time doPost is called successfully.
+// With SpoolDir empty, a failed POST is dropped.
+func (c *APIClient) doPost(path string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal request for %s failed: %s", c.assembleURL(path), err)
+	}
+
+	if err := c.post(path, payload); err != nil {
+		c.spool(path, payload)
+		return err
+	}
+
+	atomic.AddUint64(&c.reportedTotal, 1)
+	c.replaySpool()
+	return nil
+}
+
+func (c *APIClient) post(path string, payload []byte) error {
 	res, err := c.client.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(postData).
 		ForceContentType("application/json").
+		SetBody(payload).
 		Post(path)
 
 	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
+// spoolEntry is the on-disk envelope for a failed POST: the path it was
+// bound for plus its already-marshaled body. Keeping the two together
+// (rather than folding path into the filename) avoids any ambiguity for
+// endpoint paths that contain characters used as filename separators.
+type spoolEntry struct {
+	Path    string          `json:"path"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// spool persists a failed POST payload to SpoolDir so ReportUserTraffic and
+// friends don't silently lose billing data on a brief panel outage. SpoolDir
+// is capped at spoolMaxEntries: once full, the oldest entry is evicted to
+// make room, so a prolonged outage degrades to "lose the oldest reports"
+// rather than filling the disk.
+//
+// spoolMu is held for the duration of spool/replaySpool so two goroutines
+// calling doPost concurrently (e.g. separate traffic/status tickers) can't
+// race on the spool directory or replay the same chunk twice.
+func (c *APIClient) spool(path string, payload []byte) {
+	if c.SpoolDir == "" {
+		return
+	}
+
+	c.spoolMu.Lock()
+	defer c.spoolMu.Unlock()
+
+	if err := os.MkdirAll(c.SpoolDir, 0o755); err != nil {
+		c.logger.WithField("path", path).Warnf("spool failed: %s", err)
+		return
+	}
+
+	c.evictOldestSpoolEntriesLocked(spoolMaxEntries - 1)
+
+	entry, err := json.Marshal(spoolEntry{Path: path, Payload: payload})
 	if err != nil {
-		return err
+		c.logger.WithField("path", path).Warnf("spool failed: %s", err)
+		return
 	}
 
-	return nil
+	c.spoolSeq++
+	name := fmt.Sprintf("%d-%d.json", time.Now().UnixNano(), c.spoolSeq)
+	if err := os.WriteFile(filepath.Join(c.SpoolDir, name), entry, 0o644); err != nil {
+		c.logger.WithField("path", path).Warnf("spool failed: %s", err)
+		return
+	}
+
+	atomic.AddUint64(&c.spooledTotal, 1)
+	c.bumpReplayBackoffLocked()
+}
+
+// evictOldestSpoolEntriesLocked removes the oldest spooled files until at
+// most keep remain, making room for a new entry without growing SpoolDir
+// past spoolMaxEntries. Callers must hold spoolMu.
+func (c *APIClient) evictOldestSpoolEntriesLocked(keep int) {
+	entries, err := os.ReadDir(c.SpoolDir)
+	if err != nil || len(entries) <= keep {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, dirEntry := range entries[:len(entries)-keep] {
+		if err := os.Remove(filepath.Join(c.SpoolDir, dirEntry.Name())); err != nil {
+			continue
+		}
+		c.logger.WithField("file", dirEntry.Name()).Warnf("spool full, dropped oldest entry")
+	}
+}
+
+// replaySpool retries previously-spooled chunks from SpoolDir, oldest
+// first. It backs off on the first failed chunk rather than hammering a
+// panel that's still down. See spool for the locking rationale.
+func (c *APIClient) replaySpool() {
+	if c.SpoolDir == "" {
+		return
+	}
+
+	c.spoolMu.Lock()
+	defer c.spoolMu.Unlock()
+
+	if time.Now().Before(c.nextReplayAt) {
+		return
+	}
+
+	entries, err := os.ReadDir(c.SpoolDir)
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, dirEntry := range entries {
+		full := filepath.Join(c.SpoolDir, dirEntry.Name())
+		raw, err := os.ReadFile(full)
+		if err != nil {
+			continue
+		}
+
+		var entry spoolEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			c.logger.WithField("file", dirEntry.Name()).Warnf("discarding unreadable spool file: %s", err)
+			os.Remove(full)
+			continue
+		}
+
+		if err := c.post(entry.Path, entry.Payload); err != nil {
+			c.bumpReplayBackoffLocked()
+			return
+		}
+
+		os.Remove(full)
+		atomic.AddUint64(&c.replayedTotal, 1)
+		c.replayBackoff = 0
+	}
 }
 
-// GetNodeRule will pull the audit rule form pmpanel
+// bumpReplayBackoffLocked applies exponential backoff to the next spool
+// replay attempt. Callers must hold spoolMu.
+func (c *APIClient) bumpReplayBackoffLocked() {
+	if c.replayBackoff == 0 {
+		c.replayBackoff = spoolBaseBackoff
+	} else {
+		c.replayBackoff *= 2
+		if c.replayBackoff > spoolMaxBackoff {
+			c.replayBackoff = spoolMaxBackoff
+		}
+	}
+	c.nextReplayAt = time.Now().Add(c.replayBackoff)
+}
+
+// RuleUpdateInterval reports how often the caller should poll GetNodeRule,
+// as configured via api.Config.RuleUpdatePeriod.
+func (c *APIClient) RuleUpdateInterval() time.Duration {
+	return c.RuleUpdatePeriod
+}
+
+// GetNodeRule will pull the audit rule form pmpanel, merging it with the
+// local rule list read from RuleListPath. Callers should poll it on
+// RuleUpdateInterval(); the ETag handshake above keeps a tight interval cheap.
 func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
-	ruleList := c.LocalRuleList
-	return &ruleList, nil
-	// path := "/api/rules"
-	// res, err := c.client.R().
-	// 	SetResult(&Response{}).
-	// 	ForceContentType("application/json").
-	// 	Get(path)
+	path := "/api/rules"
+	req := c.client.R().ForceContentType("application/json")
+	if c.ruleETag != "" {
+		req.SetHeader("If-None-Match", c.ruleETag)
+	}
+	res, err := req.Get(path)
+	if err == nil && res.StatusCode() == http.StatusNotModified {
+		return c.lastRuleList, api.ErrRuleNotModified
+	}
 
-	// response, err := c.parseResponse(res, path, err)
-	// if err != nil {
-	// 	return nil, err
-	// }
+	responseData, err := c.parseResponse(res, path, err)
+	if err != nil {
+		return nil, err
+	}
+
+	etag := res.Header().Get("ETag")
+	if etag == "" {
+		etag = hashResponse(responseData)
+	}
+	if etag == c.ruleETag {
+		return c.lastRuleList, api.ErrRuleNotModified
+	}
+
+	var ruleListResponse []RuleItem
+	if err := json.Unmarshal(responseData, &ruleListResponse); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %s", reflect.TypeOf(ruleListResponse), err)
+	}
 
-	// ruleListResponse := new([]RuleItem)
+	seen := make(map[string]struct{}, len(ruleListResponse)+len(c.LocalRuleList))
+	ruleList := make([]api.DetectRule, 0, len(ruleListResponse)+len(c.LocalRuleList))
+	for _, r := range ruleListResponse {
+		if _, ok := seen[r.Content]; ok {
+			continue
+		}
+		pattern, err := regexp.Compile(r.Content)
+		if err != nil {
+			c.logger.WithField("rule_id", r.ID).WithField("rule_content", r.Content).Warnf("skip invalid rule: %s", err)
+			continue
+		}
+		seen[r.Content] = struct{}{}
+		ruleList = append(ruleList, api.DetectRule{ID: r.ID, Pattern: pattern})
+	}
+	for _, r := range c.LocalRuleList {
+		if _, ok := seen[r.Pattern.String()]; ok {
+			continue
+		}
+		seen[r.Pattern.String()] = struct{}{}
+		ruleList = append(ruleList, r)
+	}
 
-	// if err := json.Unmarshal(response.Data, ruleListResponse); err != nil {
-	// 	return nil, fmt.Errorf("unmarshal %s failed: %s", reflect.TypeOf(ruleListResponse), err)
-	// }
+	c.ruleETag = etag
+	c.lastRuleList = &ruleList
 
-	// for _, r := range *ruleListResponse {
-	// 	ruleList = append(ruleList, api.DetectRule{
-	// 		ID:      r.ID,
-	// 		Pattern: regexp.MustCompile(r.Content),
-	// 	})
-	// }
-	// return &ruleList, nil
+	return &ruleList, nil
 }
 
 // ReportIllegal reports the user illegal behaviors
 func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
-	return nil
+	data := make([]DetectResult, len(*detectResultList))
+	for i, d := range *detectResultList {
+		data[i] = DetectResult{UID: d.UID, RuleID: d.RuleID, HitAt: d.HitAt}
+	}
+
+	return c.doPost("/api/node/detect", &DetectResultPostData{Detect: data})
+}
+
+// parseTransport extracts the transport-specific host/path/serviceName
+// fields for the given network type from a NodeInfoResponse.
+func parseTransport(network string, nodeInfoResponse *NodeInfoResponse) (host, path, serviceName string) {
+	switch network {
+	case "ws", "h2", "httpupgrade":
+		host = nodeInfoResponse.Host
+		path = nodeInfoResponse.Path
+	case "grpc":
+		serviceName = nodeInfoResponse.ServiceName
+		if serviceName == "" {
+			serviceName = nodeInfoResponse.Sni
+		}
+	case "tcp":
+		// no extra fields
+	}
+	return host, path, serviceName
 }
 
 // ParseV2rayNodeResponse parse the response for the given nodeinfor format
 func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *NodeInfoResponse) (*api.NodeInfo, error) {
-	// var enableTLS bool
-	// var path, host, transportProtocol, serviceName string
-	// var speedLimit uint64 = 0
-
-	// port := nodeInfoResponse.Port
-	// alterID := nodeInfoResponse.AlterId
-	// transportProtocol = nodeInfoResponse.Network
-	// switch transportProtocol {
-	// case "ws":
-	// 	host = nodeInfoResponse.Host
-	// 	path = nodeInfoResponse.Path
-	// case "grpc":
-	// 	serviceName = nodeInfoResponse.Sni
-	// case "tcp":
-	// 	// TODO
-	// }
-	// // Compatible with more node types config
-	// switch nodeInfoResponse.Security {
-	// case "tls":
-	// 	enableTLS = true
-	// default:
-	// 	enableTLS = false
-	// }
-	// if c.SpeedLimit > 0 {
-	// 	speedLimit = uint64((c.SpeedLimit * 1000000) / 8)
-	// } else {
-	// 	speedLimit = uint64((nodeInfoResponse.SpeedLimit * 1000000) / 8)
-	// }
-	// // Create GeneralNodeInfo
-	// nodeinfo := &api.NodeInfo{
-	// 	NodeType:          c.NodeType,
-	// 	NodeID:            c.NodeID,
-	// 	Port:              port,
-	// 	SpeedLimit:        speedLimit,
-	// 	AlterID:           alterID,
-	// 	TransportProtocol: transportProtocol,
-	// 	EnableTLS:         enableTLS,
-	// 	Path:              path,
-	// 	Host:              host,
-	// 	EnableVless:       c.EnableVless,
-	// 	VlessFlow:         c.VlessFlow,
-	// 	ServiceName:       serviceName,
-	// }
-
-	// return nodeinfo, nil
-	return nil, nil
+	var enableTLS, enableXTLS bool
+	var speedLimit uint64 = 0
+	var realityDest, realityPrivateKey string
+	var realityServerNames, realityShortIds []string
+
+	port := nodeInfoResponse.Port
+	alterID := nodeInfoResponse.AlterId
+	transportProtocol := nodeInfoResponse.Network
+	host, path, serviceName := parseTransport(transportProtocol, nodeInfoResponse)
+
+	// Compatible with more node types config
+	switch nodeInfoResponse.Security {
+	case "tls":
+		enableTLS = true
+	case "xtls":
+		enableTLS = true
+		enableXTLS = true
+	case "reality":
+		enableTLS = true
+		realityDest = nodeInfoResponse.RealityDest
+		realityServerNames = nodeInfoResponse.RealityServerNames
+		realityPrivateKey = nodeInfoResponse.RealityPrivateKey
+		realityShortIds = nodeInfoResponse.RealityShortIds
+	default:
+		enableTLS = false
+	}
+	// c.EnableXTLS is an operator override (e.g. forcing XTLS on a node the
+	// panel hasn't been updated to report as such yet); it's ORed in rather
+	// than replacing what the panel reports.
+	if c.EnableXTLS {
+		enableTLS = true
+		enableXTLS = true
+	}
+	if c.SpeedLimit > 0 {
+		speedLimit = uint64((c.SpeedLimit * 1000000) / 8)
+	} else {
+		speedLimit = uint64((nodeInfoResponse.SpeedLimit * 1000000) / 8)
+	}
+	// Create GeneralNodeInfo
+	nodeinfo := &api.NodeInfo{
+		NodeType:           c.NodeType,
+		NodeID:             c.NodeID,
+		Port:               port,
+		SpeedLimit:         speedLimit,
+		AlterID:            alterID,
+		TransportProtocol:  transportProtocol,
+		EnableTLS:          enableTLS,
+		Path:               path,
+		Host:               host,
+		EnableVless:        c.EnableVless,
+		VlessFlow:          c.VlessFlow,
+		ServiceName:        serviceName,
+		EnableXTLS:         enableXTLS,
+		RealityDest:        realityDest,
+		RealityServerNames: realityServerNames,
+		RealityPrivateKey:  realityPrivateKey,
+		RealityShortIds:    realityShortIds,
+	}
+
+	return nodeinfo, nil
 }
 
 // ParseSSNodeResponse parse the response for the given nodeinfor format
@@ -398,36 +806,63 @@ func (c *APIClient) ParseSSNodeResponse(nodeInfoResponse *NodeInfoResponse) (*ap
 
 // ParseTrojanNodeResponse parse the response for the given nodeinfor format
 func (c *APIClient) ParseTrojanNodeResponse(nodeInfoResponse *NodeInfoResponse) (*api.NodeInfo, error) {
-	// // 域名或IP;port=连接端口#偏移端口|host=xx
-	// // gz.aaa.com;port=443#12345|host=hk.aaa.com
-	// var host string
-	// var transportProtocol = "tcp"
-	// var speedlimit uint64 = 0
-	// host = nodeInfoResponse.Host
-	// port := nodeInfoResponse.Port
-
-	// if c.SpeedLimit > 0 {
-	// 	speedlimit = uint64((c.SpeedLimit * 1000000) / 8)
-	// } else {
-	// 	speedlimit = uint64((nodeInfoResponse.SpeedLimit * 1000000) / 8)
-	// }
-	// if nodeInfoResponse.Grpc {
-	// 	transportProtocol = "grpc"
-	// }
-	// // Create GeneralNodeInfo
-	// nodeInfo := &api.NodeInfo{
-	// 	NodeType:          c.NodeType,
-	// 	NodeID:            c.NodeID,
-	// 	Port:              port,
-	// 	SpeedLimit:        speedlimit,
-	// 	TransportProtocol: transportProtocol,
-	// 	EnableTLS:         true,
-	// 	Host:              host,
-	// 	ServiceName:       nodeInfoResponse.Sni,
-	// }
-
-	// return nodeInfo, nil
-	return nil, nil
+	// 域名或IP;port=连接端口#偏移端口|host=xx
+	// gz.aaa.com;port=443#12345|host=hk.aaa.com
+	var enableXTLS bool
+	var speedlimit uint64 = 0
+	var realityDest, realityPrivateKey string
+	var realityServerNames, realityShortIds []string
+
+	host := nodeInfoResponse.Host
+	port := nodeInfoResponse.Port
+	transportProtocol := nodeInfoResponse.Network
+	if transportProtocol == "" {
+		transportProtocol = "tcp"
+	}
+	_, path, serviceName := parseTransport(transportProtocol, nodeInfoResponse)
+	if serviceName == "" {
+		serviceName = nodeInfoResponse.Sni
+	}
+
+	switch nodeInfoResponse.Security {
+	case "xtls":
+		enableXTLS = true
+	case "reality":
+		realityDest = nodeInfoResponse.RealityDest
+		realityServerNames = nodeInfoResponse.RealityServerNames
+		realityPrivateKey = nodeInfoResponse.RealityPrivateKey
+		realityShortIds = nodeInfoResponse.RealityShortIds
+	}
+	// c.EnableXTLS is an operator override; OR it in rather than replacing
+	// what the panel reports (trojan is always TLS already).
+	if c.EnableXTLS {
+		enableXTLS = true
+	}
+
+	if c.SpeedLimit > 0 {
+		speedlimit = uint64((c.SpeedLimit * 1000000) / 8)
+	} else {
+		speedlimit = uint64((nodeInfoResponse.SpeedLimit * 1000000) / 8)
+	}
+	// Create GeneralNodeInfo
+	nodeInfo := &api.NodeInfo{
+		NodeType:           c.NodeType,
+		NodeID:             c.NodeID,
+		Port:               port,
+		SpeedLimit:         speedlimit,
+		TransportProtocol:  transportProtocol,
+		EnableTLS:          true,
+		EnableXTLS:         enableXTLS,
+		Host:               host,
+		Path:               path,
+		ServiceName:        serviceName,
+		RealityDest:        realityDest,
+		RealityServerNames: realityServerNames,
+		RealityPrivateKey:  realityPrivateKey,
+		RealityShortIds:    realityShortIds,
+	}
+
+	return nodeInfo, nil
 }
 
 // ParseUserListResponse parse the response for the given nodeinfo format
@@ -0,0 +1,125 @@
+package pmpanel
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// goldenNodeInfoResponse builds a NodeInfoResponse fixture for the given
+// transport/security combination, covering the transport, security and
+// reality fields the parsers read (ws/h2/httpupgrade host+path, grpc service
+// name, reality bundle; alter_id is not set) so the
+// same fixture can drive both the v2ray and trojan parsers.
+func goldenNodeInfoResponse(network, security string) string {
+	return fmt.Sprintf(`{
+		"port": 443,
+		"network": %q,
+		"security": %q,
+		"host": "node.example.com",
+		"path": "/ws",
+		"service_name": "grpc-svc",
+		"sni": "node.example.com",
+		"speed_limit": 0,
+		"reality_dest": "example.com:443",
+		"reality_server_names": ["example.com"],
+		"reality_private_key": "priv-key",
+		"reality_short_ids": ["ab12"]
+	}`, network, security)
+}
+
+func TestParseV2rayNodeResponse(t *testing.T) {
+	transports := []string{"tcp", "ws", "grpc", "h2", "httpupgrade"}
+	securities := []string{"tls", "xtls", "reality"}
+
+	for _, network := range transports {
+		for _, security := range securities {
+			t.Run(network+"/"+security, func(t *testing.T) {
+				resp := new(NodeInfoResponse)
+				if err := json.Unmarshal([]byte(goldenNodeInfoResponse(network, security)), resp); err != nil {
+					t.Fatalf("unmarshal fixture: %s", err)
+				}
+
+				c := &APIClient{NodeType: "V2ray", NodeID: "1", VlessFlow: "xtls-rprx-vision"}
+				info, err := c.ParseV2rayNodeResponse(resp)
+				if err != nil {
+					t.Fatalf("ParseV2rayNodeResponse() error = %s", err)
+				}
+
+				if info.TransportProtocol != network {
+					t.Errorf("TransportProtocol = %q, want %q", info.TransportProtocol, network)
+				}
+				if !info.EnableTLS {
+					t.Errorf("EnableTLS = false, want true for security %q", security)
+				}
+				if wantXTLS := security == "xtls"; info.EnableXTLS != wantXTLS {
+					t.Errorf("EnableXTLS = %v, want %v", info.EnableXTLS, wantXTLS)
+				}
+
+				if security == "reality" {
+					if info.RealityDest == "" || len(info.RealityServerNames) == 0 ||
+						info.RealityPrivateKey == "" || len(info.RealityShortIds) == 0 {
+						t.Errorf("reality fields not populated: %+v", info)
+					}
+				} else if info.RealityDest != "" {
+					t.Errorf("RealityDest = %q, want empty for security %q", info.RealityDest, security)
+				}
+
+				switch network {
+				case "ws", "h2", "httpupgrade":
+					if info.Host == "" || info.Path == "" {
+						t.Errorf("host/path not populated for network %q: %+v", network, info)
+					}
+				case "grpc":
+					if info.ServiceName == "" {
+						t.Errorf("ServiceName not populated for network %q", network)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestParseTrojanNodeResponse(t *testing.T) {
+	// Trojan panels in the wild only ever configure tcp or grpc, so the
+	// matrix is narrower than v2ray's, but every security value is still
+	// exercised against both transports.
+	transports := []string{"tcp", "grpc"}
+	securities := []string{"tls", "xtls", "reality"}
+
+	for _, network := range transports {
+		for _, security := range securities {
+			t.Run(network+"/"+security, func(t *testing.T) {
+				resp := new(NodeInfoResponse)
+				if err := json.Unmarshal([]byte(goldenNodeInfoResponse(network, security)), resp); err != nil {
+					t.Fatalf("unmarshal fixture: %s", err)
+				}
+
+				c := &APIClient{NodeType: "Trojan", NodeID: "1"}
+				info, err := c.ParseTrojanNodeResponse(resp)
+				if err != nil {
+					t.Fatalf("ParseTrojanNodeResponse() error = %s", err)
+				}
+
+				if info.TransportProtocol != network {
+					t.Errorf("TransportProtocol = %q, want %q", info.TransportProtocol, network)
+				}
+				if !info.EnableTLS {
+					t.Errorf("EnableTLS = false, want true (trojan always tunnels over TLS)")
+				}
+				if wantXTLS := security == "xtls"; info.EnableXTLS != wantXTLS {
+					t.Errorf("EnableXTLS = %v, want %v", info.EnableXTLS, wantXTLS)
+				}
+				if security == "reality" && info.RealityDest == "" {
+					t.Errorf("RealityDest not populated for reality fixture")
+				}
+				if info.Host == "" {
+					t.Errorf("Host not populated")
+				}
+				if network == "grpc" && info.ServiceName == "" {
+					t.Errorf("ServiceName not populated for grpc")
+				}
+			})
+		}
+	}
+}